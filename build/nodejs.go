@@ -3,27 +3,80 @@ package build
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 
 	"github.com/bmatcuk/doublestar"
 	logging "github.com/op/go-logging"
+	yaml "gopkg.in/yaml.v2"
 
 	"github.com/fossas/fossa-cli/module"
 )
 
 var nodejsLogger = logging.MustGetLogger("nodejs")
 
+// execCommand runs `name args...` in dir and returns its combined
+// stdout+stderr. On failure, the returned error is wrapped with the command
+// name, its exact argv, the working directory, and the trimmed output tail,
+// so a failing install (missing registry auth, peer conflicts, ENOSPC)
+// surfaces as more than an opaque "exit status 1".
+func execCommand(dir, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return output, fmt.Errorf("%s %s (in %#v) failed: %s\n%s", name, strings.Join(args, " "), dir, err, tailLines(string(output), 20))
+	}
+	return output, nil
+}
+
+// tailLines returns at most the last n non-empty lines of output, so wrapped
+// errors carry the relevant part of a (possibly long) subprocess log.
+func tailLines(output string, n int) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
 // NodeModule implements Dependency for NodeJSBuilder.
 type NodeModule struct {
 	Name    string `json:"name"`
 	Version string `json:"version"`
+
+	// Resolved, Integrity, and Dependencies are populated when a module is
+	// parsed from a lockfile, which captures the true resolved dependency
+	// graph rather than a flat, hoisted `node_modules` listing. They're
+	// tagged `json:"-"` so they don't collide with fields of the same name
+	// on a plain `package.json` (e.g. its `dependencies` object).
+	Resolved     string   `json:"-"`
+	Integrity    string   `json:"-"`
+	Dependencies []string `json:"-"`
+
+	// DepScope records where in the dependency tree this module was reached
+	// from: `prod`, `dev`, `optional`, `peer`, or `bundled`.
+	DepScope DepScope `json:"scope,omitempty"`
 }
 
+// DepScope classifies a NodeModule by how the root package.json depends on
+// it (directly or transitively).
+type DepScope string
+
+const (
+	ScopeProd     DepScope = "prod"
+	ScopeDev      DepScope = "dev"
+	ScopeOptional DepScope = "optional"
+	ScopePeer     DepScope = "peer"
+	ScopeBundled  DepScope = "bundled"
+)
+
 // Fetcher always returns npm for NodeModule. TODO: Support git and other
 // dependency sources.
 func (m NodeModule) Fetcher() string {
@@ -51,6 +104,9 @@ type NodeJSBuilder struct {
 
 	YarnCmd     string
 	YarnVersion string
+
+	PnpmCmd     string
+	PnpmVersion string
 }
 
 // Initialize collects environment data for Nodejs builds
@@ -66,8 +122,8 @@ func (builder *NodeJSBuilder) Initialize() error {
 			continue
 		}
 
-		nodeVersionOutput, err := exec.Command(nodeCmds[i], "-v").Output()
-		if err == nil && nodeVersionOutput[0] == 'v' {
+		nodeVersionOutput, err := execCommand(".", nodeCmds[i], "-v")
+		if err == nil && len(nodeVersionOutput) > 0 && nodeVersionOutput[0] == 'v' {
 			builder.NodeVersion = strings.TrimSpace(string(nodeVersionOutput))[1:]
 			builder.NodeCmd = nodeCmds[i]
 			break
@@ -80,7 +136,7 @@ func (builder *NodeJSBuilder) Initialize() error {
 		builder.NpmCmd = "npm"
 	}
 
-	npmVersionOutput, err := exec.Command(builder.NpmCmd, "-v").Output()
+	npmVersionOutput, err := execCommand(".", builder.NpmCmd, "-v")
 	if err == nil && len(npmVersionOutput) >= 5 {
 		builder.NpmVersion = strings.TrimSpace(string(npmVersionOutput))
 	}
@@ -90,13 +146,23 @@ func (builder *NodeJSBuilder) Initialize() error {
 	if builder.YarnCmd == "" {
 		builder.YarnCmd = "yarn"
 	}
-	yarnVersionOutput, err := exec.Command(builder.YarnCmd, "-v").Output()
+	yarnVersionOutput, err := execCommand(".", builder.YarnCmd, "-v")
 	if err == nil && len(yarnVersionOutput) >= 5 {
 		builder.YarnVersion = strings.TrimSpace(string(yarnVersionOutput))
 	}
 
-	if (builder.NpmCmd == "" || builder.NpmVersion == "") && (builder.YarnCmd == "" || builder.YarnVersion == "") {
-		return errors.New("could not find NPM binary or Yarn binary (try setting $NPM_BINARY or $YARN_BINARY)")
+	// Set pnpm context variables
+	builder.PnpmCmd = os.Getenv("PNPM_BINARY")
+	if builder.PnpmCmd == "" {
+		builder.PnpmCmd = "pnpm"
+	}
+	pnpmVersionOutput, err := execCommand(".", builder.PnpmCmd, "-v")
+	if err == nil && len(pnpmVersionOutput) >= 5 {
+		builder.PnpmVersion = strings.TrimSpace(string(pnpmVersionOutput))
+	}
+
+	if (builder.NpmCmd == "" || builder.NpmVersion == "") && (builder.YarnCmd == "" || builder.YarnVersion == "") && (builder.PnpmCmd == "" || builder.PnpmVersion == "") {
+		return errors.New("could not find NPM binary, Yarn binary, or pnpm binary (try setting $NPM_BINARY, $YARN_BINARY, or $PNPM_BINARY)")
 	}
 
 	nodejsLogger.Debugf("Initialized Nodejs builder: %#v", builder)
@@ -108,37 +174,621 @@ func (builder *NodeJSBuilder) Build(m module.Module, force bool) error {
 	nodejsLogger.Debugf("Running Nodejs build...")
 	if force {
 		nodejsLogger.Debug("`force` flag is set; clearing `node_modules`...")
-		cmd := exec.Command("rm", "-rf", "node_modules")
-		cmd.Dir = m.Dir
-		_, err := cmd.Output()
-		if err != nil {
+		if _, err := execCommand(m.Dir, "rm", "-rf", "node_modules"); err != nil {
 			return err
 		}
 	}
 
-	// Prefer Yarn where possible
+	// Prefer pnpm, then Yarn, where possible
+	if _, err := os.Stat(filepath.Join(m.Dir, "pnpm-lock.yaml")); err == nil {
+		nodejsLogger.Debugf("pnpm lockfile detected.")
+		if builder.PnpmCmd == "" {
+			return errors.New("pnpm lockfile found but could not find pnpm binary (try setting $PNPM_BINARY)")
+		}
+
+		nodejsLogger.Debugf("Running `pnpm install --prod --frozen-lockfile`.")
+		_, err := execCommand(m.Dir, builder.PnpmCmd, "install", "--prod", "--frozen-lockfile")
+		return err
+	}
+
 	if _, err := os.Stat(filepath.Join(m.Dir, "yarn.lock")); err == nil {
 		nodejsLogger.Debugf("Yarn lockfile detected.")
 		if builder.YarnCmd == "" {
 			return errors.New("Yarn lockfile found but could not find Yarn binary (try setting $YARN_BINARY)")
 		}
 
-		// TODO(xizhao): Verify compatible yarn versions
+		if yarnMajorVersion(builder.YarnVersion) >= 2 {
+			// Yarn 2+ (Berry) dropped `--production`/`--frozen-lockfile` in
+			// favor of `--immutable`, and may use Plug'n'Play instead of
+			// `node_modules` entirely.
+			nodejsLogger.Debugf("Running `yarn install --immutable`.")
+			_, err := execCommand(m.Dir, builder.YarnCmd, "install", "--immutable")
+			return err
+		}
+
 		nodejsLogger.Debugf("Running `yarn install --production --frozen-lockfile`.")
-		cmd := exec.Command(builder.YarnCmd, "install", "--production", "--frozen-lockfile")
-		cmd.Dir = m.Dir
-		_, err := cmd.Output()
+		_, err := execCommand(m.Dir, builder.YarnCmd, "install", "--production", "--frozen-lockfile")
 		return err
 	}
 
-	cmd := exec.Command(builder.NpmCmd, "install", "--production")
-	cmd.Dir = m.Dir
-	_, err := cmd.Output()
+	_, err := execCommand(m.Dir, builder.NpmCmd, "install", "--production")
 	return err
 }
 
-func (builder *NodeJSBuilder) Analyze(m module.Module, _ bool) ([]module.Dependency, error) {
-	nodejsLogger.Debugf("Running analysis on Nodejs module...")
+// yarnMajorVersion extracts the major version number from a Yarn version
+// string (e.g. "3.2.0" -> 3). It returns 1 if the version can't be parsed,
+// since Yarn Classic (1.x) is the default assumption.
+func yarnMajorVersion(version string) int {
+	major := strings.SplitN(version, ".", 2)[0]
+	n, err := strconv.Atoi(major)
+	if err != nil {
+		return 1
+	}
+	return n
+}
+
+// yarnPnpManifest models the subset of a Yarn Plug'n'Play manifest
+// (`.pnp.data.json`) needed to enumerate resolved packages.
+// `packageRegistryData` is Yarn's own `Map<packageName, Map<packageReference,
+// PackageInformation>>` (see `hydrateRuntimeState` in `@yarnpkg/pnp`), and a
+// JS `Map` with nullable keys can't round-trip through a plain JSON object,
+// so Yarn serializes each level as an array of `[key, value]` tuples instead
+// of a keyed object.
+type yarnPnpManifest struct {
+	PackageRegistryData []yarnPnpRegistryEntry `json:"packageRegistryData"`
+}
+
+// yarnPnpRegistryEntry is a `[packageName, referenceEntries]` tuple. The
+// workspace root is recorded with a null packageName.
+type yarnPnpRegistryEntry struct {
+	PackageName      *string
+	ReferenceEntries []yarnPnpReferenceEntry
+}
+
+func (e *yarnPnpRegistryEntry) UnmarshalJSON(data []byte) error {
+	var tuple [2]json.RawMessage
+	if err := json.Unmarshal(data, &tuple); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(tuple[0], &e.PackageName); err != nil {
+		return err
+	}
+	return json.Unmarshal(tuple[1], &e.ReferenceEntries)
+}
+
+// yarnPnpReferenceEntry is a `[reference, packageInformation]` tuple.
+type yarnPnpReferenceEntry struct {
+	Reference *string
+	Info      yarnPnpPackageInformation
+}
+
+func (e *yarnPnpReferenceEntry) UnmarshalJSON(data []byte) error {
+	var tuple [2]json.RawMessage
+	if err := json.Unmarshal(data, &tuple); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(tuple[0], &e.Reference); err != nil {
+		return err
+	}
+	return json.Unmarshal(tuple[1], &e.Info)
+}
+
+// yarnPnpPackageInformation is the resolved metadata Yarn stores for one
+// (packageName, reference) pair.
+type yarnPnpPackageInformation struct {
+	PackageDependencies []yarnPnpDependencyEntry `json:"packageDependencies"`
+}
+
+// yarnPnpDependencyEntry is a `[name, reference]` tuple; reference is null
+// for an unmet peer dependency.
+type yarnPnpDependencyEntry struct {
+	Name      string
+	Reference *string
+}
+
+func (e *yarnPnpDependencyEntry) UnmarshalJSON(data []byte) error {
+	var tuple [2]json.RawMessage
+	if err := json.Unmarshal(data, &tuple); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(tuple[0], &e.Name); err != nil {
+		return err
+	}
+	return json.Unmarshal(tuple[1], &e.Reference)
+}
+
+// yarnPnpNpmReferencePrefix marks a PnP reference as resolved from the npm
+// registry, e.g. `npm:4.17.21` or, against an alternate registry,
+// `npm:4.17.21::__archiveUrl=...`. Other protocols (`workspace:`, `patch:`,
+// `portal:`, `link:`) name something other than a published npm version.
+const yarnPnpNpmReferencePrefix = "npm:"
+
+// cleanYarnPnpReference strips the `npm:` resolver protocol and any
+// trailing `::`-separated parameters from a PnP reference, leaving a plain
+// version, e.g. `npm:4.17.21::__archiveUrl=...` -> `4.17.21`.
+func cleanYarnPnpReference(reference string) string {
+	if !strings.HasPrefix(reference, yarnPnpNpmReferencePrefix) {
+		return reference
+	}
+	reference = strings.TrimPrefix(reference, yarnPnpNpmReferencePrefix)
+	if idx := strings.Index(reference, "::"); idx >= 0 {
+		reference = reference[:idx]
+	}
+	return reference
+}
+
+// pnpHydrateCallMarker is the prefix of the call Yarn Berry's `.pnp.cjs`
+// loader makes to deserialize its inlined resolution data, e.g.
+// `hydrateRuntimeState(JSON.parse('{"packageRegistryData":[...]}'), {...})`.
+const pnpHydrateCallMarker = "hydrateRuntimeState(JSON.parse("
+
+// extractPnpInlineData pulls the JSON manifest out of a `.pnp.cjs` loader's
+// `hydrateRuntimeState(JSON.parse(...))` call. Yarn Berry defaults
+// `pnpEnableInlining` to true, which embeds the resolution data directly in
+// the loader as a quoted JS string literal instead of writing a separate
+// `.pnp.data.json`, so this is the only way to recover it in that (default)
+// configuration.
+func extractPnpInlineData(contents string) (string, error) {
+	idx := strings.Index(contents, pnpHydrateCallMarker)
+	if idx < 0 {
+		return "", errors.New("no hydrateRuntimeState(JSON.parse(...)) call found")
+	}
+
+	rest := contents[idx+len(pnpHydrateCallMarker):]
+	if rest == "" {
+		return "", errors.New("truncated after hydrateRuntimeState(JSON.parse(")
+	}
+
+	quote := rest[0]
+	if quote != '\'' && quote != '"' && quote != '`' {
+		return "", fmt.Errorf("unexpected literal delimiter %q", quote)
+	}
+	rest = rest[1:]
+
+	var literal strings.Builder
+	for i := 0; i < len(rest); i++ {
+		c := rest[i]
+		if c == '\\' && i+1 < len(rest) {
+			literal.WriteByte(unescapeJSChar(rest[i+1]))
+			i++
+			continue
+		}
+		if c == quote {
+			return literal.String(), nil
+		}
+		literal.WriteByte(c)
+	}
+
+	return "", errors.New("unterminated runtime state literal")
+}
+
+// unescapeJSChar resolves the character following a backslash in a JS string
+// literal to the byte it actually represents.
+func unescapeJSChar(c byte) byte {
+	switch c {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	default:
+		// Covers `\\`, `\'`, `\"`, `` \` ``, `\/`, and anything else passed
+		// through verbatim, which is what JS does for unrecognized escapes.
+		return c
+	}
+}
+
+// analyzeYarnPnp parses a Yarn Plug'n'Play manifest instead of walking
+// `node_modules`, since Berry projects using PnP never install one.
+// `manifestPath` may be a standalone `.pnp.data.json` or a `.pnp.cjs` loader
+// with the manifest inlined (the latter is Yarn Berry's default); `.cjs`
+// content is detected by extension and the embedded JSON is extracted first.
+func analyzeYarnPnp(manifestPath string) ([]module.Dependency, error) {
+	nodejsLogger.Debugf("Parsing Yarn PnP manifest at %#v", manifestPath)
+	contents, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+
+	manifestJSON := contents
+	if filepath.Ext(manifestPath) == ".cjs" {
+		inline, err := extractPnpInlineData(string(contents))
+		if err != nil {
+			return nil, fmt.Errorf("could not extract inline PnP data from %#v: %s", manifestPath, err)
+		}
+		manifestJSON = []byte(inline)
+	}
+
+	var manifest yarnPnpManifest
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		return nil, err
+	}
+
+	var deps []module.Dependency
+	for _, entry := range manifest.PackageRegistryData {
+		// A null packageName marks the registry's own anonymous root entry,
+		// not a resolved package.
+		if entry.PackageName == nil {
+			continue
+		}
+
+		for _, ref := range entry.ReferenceEntries {
+			// A null reference alongside it is Yarn's corresponding
+			// placeholder for that same root entry.
+			if ref.Reference == nil {
+				continue
+			}
+
+			version := cleanYarnPnpReference(*ref.Reference)
+			if strings.HasPrefix(version, "workspace:") {
+				// This is the workspace project itself (or a sibling
+				// workspace), not an external dependency.
+				continue
+			}
+
+			children := make([]string, 0, len(ref.Info.PackageDependencies))
+			for _, dep := range ref.Info.PackageDependencies {
+				// Yarn always lists a package among its own
+				// packageDependencies (pointing back at itself), which isn't
+				// a real edge.
+				if dep.Name == *entry.PackageName {
+					continue
+				}
+				if dep.Reference == nil {
+					children = append(children, dep.Name)
+					continue
+				}
+				children = append(children, dep.Name+"@"+cleanYarnPnpReference(*dep.Reference))
+			}
+
+			deps = append(deps, NodeModule{Name: *entry.PackageName, Version: version, Dependencies: children})
+		}
+	}
+
+	return deps, nil
+}
+
+// npmLockfileHeader is decoded first to determine which `package-lock.json`
+// shape to parse the rest of the file as.
+type npmLockfileHeader struct {
+	LockfileVersion int `json:"lockfileVersion"`
+}
+
+// npmLockV1Entry is a single (possibly nested, for hoisting overrides) entry
+// in a `package-lock.json` v1 `dependencies` tree.
+type npmLockV1Entry struct {
+	Version      string                    `json:"version"`
+	Resolved     string                    `json:"resolved"`
+	Integrity    string                    `json:"integrity"`
+	Requires     map[string]string         `json:"requires"`
+	Dependencies map[string]npmLockV1Entry `json:"dependencies"`
+}
+
+type npmPackageLockV1 struct {
+	LockfileVersion int                       `json:"lockfileVersion"`
+	Dependencies    map[string]npmLockV1Entry `json:"dependencies"`
+}
+
+// npmLockV2Entry is a single entry in a `package-lock.json` v2/v3 `packages`
+// map, keyed by install path (e.g. `node_modules/foo/node_modules/bar`).
+type npmLockV2Entry struct {
+	Name         string            `json:"name"`
+	Version      string            `json:"version"`
+	Resolved     string            `json:"resolved"`
+	Integrity    string            `json:"integrity"`
+	Dependencies map[string]string `json:"dependencies"`
+}
+
+type npmPackageLockV2 struct {
+	LockfileVersion int                       `json:"lockfileVersion"`
+	Packages        map[string]npmLockV2Entry `json:"packages"`
+}
+
+// packageNameFromNpmPath recovers a package name (including scope, e.g.
+// `@babel/core`) from a v2/v3 `package-lock.json` install path such as
+// `node_modules/foo/node_modules/@babel/core`.
+func packageNameFromNpmPath(path string) string {
+	const marker = "node_modules/"
+	idx := strings.LastIndex(path, marker)
+	if idx < 0 {
+		return ""
+	}
+	return path[idx+len(marker):]
+}
+
+// flattenNpmLockV1 walks a `package-lock.json` v1 dependency tree, emitting
+// one NodeModule per entry (including nested overrides) with edges to its
+// direct dependencies.
+func flattenNpmLockV1(entries map[string]npmLockV1Entry, deps *[]module.Dependency) {
+	for name, entry := range entries {
+		children := make([]string, 0, len(entry.Requires))
+		for child := range entry.Requires {
+			children = append(children, child)
+		}
+		*deps = append(*deps, NodeModule{
+			Name:         name,
+			Version:      entry.Version,
+			Resolved:     entry.Resolved,
+			Integrity:    entry.Integrity,
+			Dependencies: children,
+		})
+		if len(entry.Dependencies) > 0 {
+			flattenNpmLockV1(entry.Dependencies, deps)
+		}
+	}
+}
+
+// analyzePackageLockJSON parses `package-lock.json`, handling both the v1
+// nested `dependencies` tree and the v2/v3 flat `packages` map, and returns
+// the resolved dependency graph rather than a flat hoisted set.
+func analyzePackageLockJSON(lockfilePath string) ([]module.Dependency, error) {
+	nodejsLogger.Debugf("Parsing package-lock.json at %#v", lockfilePath)
+	contents, err := ioutil.ReadFile(lockfilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var header npmLockfileHeader
+	if err := json.Unmarshal(contents, &header); err != nil {
+		return nil, err
+	}
+
+	if header.LockfileVersion >= 2 {
+		var lockfile npmPackageLockV2
+		if err := json.Unmarshal(contents, &lockfile); err != nil {
+			return nil, err
+		}
+
+		var deps []module.Dependency
+		for path, pkg := range lockfile.Packages {
+			if path == "" {
+				// The root package itself, not a dependency.
+				continue
+			}
+
+			name := pkg.Name
+			if name == "" {
+				name = packageNameFromNpmPath(path)
+			}
+
+			children := make([]string, 0, len(pkg.Dependencies))
+			for child := range pkg.Dependencies {
+				children = append(children, child)
+			}
+
+			deps = append(deps, NodeModule{
+				Name:         name,
+				Version:      pkg.Version,
+				Resolved:     pkg.Resolved,
+				Integrity:    pkg.Integrity,
+				Dependencies: children,
+			})
+		}
+		return deps, nil
+	}
+
+	var lockfile npmPackageLockV1
+	if err := json.Unmarshal(contents, &lockfile); err != nil {
+		return nil, err
+	}
+
+	var deps []module.Dependency
+	flattenNpmLockV1(lockfile.Dependencies, &deps)
+	return deps, nil
+}
+
+// yarnLockDescriptorName recovers a package name from a yarn.lock descriptor
+// such as `foo@^1.0.0` or `@scope/foo@^1.0.0`.
+func yarnLockDescriptorName(descriptor string) string {
+	if idx := strings.LastIndex(descriptor, "@"); idx > 0 {
+		return descriptor[:idx]
+	}
+	return descriptor
+}
+
+// yarnLockUnquote strips a matching pair of surrounding double quotes, if
+// present, from a yarn.lock field value.
+func yarnLockUnquote(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// analyzeYarnLock parses Yarn Classic's custom line-based `yarn.lock`
+// format. Each entry begins with one or more comma-separated, unindented
+// descriptors ending in `:`, followed by indented `version`, `resolved`,
+// `integrity`, and `dependencies:` fields.
+func analyzeYarnLock(lockfilePath string) ([]module.Dependency, error) {
+	nodejsLogger.Debugf("Parsing yarn.lock at %#v", lockfilePath)
+	contents, err := ioutil.ReadFile(lockfilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var deps []module.Dependency
+	var name, version, resolved, integrity string
+	var children []string
+	inDependencies := false
+
+	flush := func() {
+		if name != "" {
+			deps = append(deps, NodeModule{
+				Name:         name,
+				Version:      version,
+				Resolved:     resolved,
+				Integrity:    integrity,
+				Dependencies: children,
+			})
+		}
+		name, version, resolved, integrity = "", "", "", ""
+		children = nil
+		inDependencies = false
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if !strings.HasPrefix(line, " ") {
+			flush()
+			header := strings.TrimSuffix(trimmed, ":")
+			firstDescriptor := strings.TrimSpace(strings.SplitN(header, ",", 2)[0])
+			name = yarnLockDescriptorName(yarnLockUnquote(firstDescriptor))
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(trimmed, "version "):
+			version = yarnLockUnquote(strings.TrimPrefix(trimmed, "version "))
+		case strings.HasPrefix(trimmed, "resolved "):
+			resolved = yarnLockUnquote(strings.TrimPrefix(trimmed, "resolved "))
+		case strings.HasPrefix(trimmed, "integrity "):
+			integrity = yarnLockUnquote(strings.TrimPrefix(trimmed, "integrity "))
+		case trimmed == "dependencies:":
+			inDependencies = true
+		case inDependencies:
+			fields := strings.Fields(trimmed)
+			if len(fields) > 0 {
+				children = append(children, yarnLockUnquote(fields[0]))
+			}
+		}
+	}
+	flush()
+
+	return deps, nil
+}
+
+// pnpmLockfile models the top-level shape of a `pnpm-lock.yaml` file.
+type pnpmLockfile struct {
+	LockfileVersion interface{}            `yaml:"lockfileVersion"`
+	Packages        map[string]pnpmPackage `yaml:"packages"`
+}
+
+// pnpmPackage models a single entry in a pnpm lockfile's `packages` map.
+type pnpmPackage struct {
+	Resolution   map[string]interface{} `yaml:"resolution"`
+	Dependencies map[string]string      `yaml:"dependencies"`
+}
+
+// parsePnpmPackageKey splits a pnpm lockfile package key into its package
+// name and resolved version, stripping any peer-dependency suffix. Keys
+// look like `/lodash/4.17.21` (v5), `/lodash@4.17.21` (v6+, scoped:
+// `/@scope/name@version`), or, once peer dependencies are involved,
+// `/lodash@4.17.21_eslint@7.0.0` (underscore-hash suffix) or
+// `/lodash@4.17.21(eslint@7.0.0)` (v7+ parenthetical suffix) — in both
+// cases the suffix's own `@` means it can't be found with a trailing
+// strings.LastIndex(key, "@") without also grabbing part of the suffix.
+func parsePnpmPackageKey(key string) (name, version string) {
+	key = strings.TrimPrefix(key, "/")
+
+	// A scoped name's own "/" (`@scope/name`) isn't the name/version
+	// boundary, so start the boundary search after it.
+	searchFrom := 0
+	if strings.HasPrefix(key, "@") {
+		if idx := strings.Index(key, "/"); idx >= 0 {
+			searchFrom = idx + 1
+		}
+	}
+
+	// v6+ keys delimit name from version with "@"; v5 keys use "/"; take
+	// whichever comes first after the scope.
+	delimOffset := strings.IndexAny(key[searchFrom:], "@/")
+	if delimOffset < 0 {
+		return key, ""
+	}
+
+	nameEnd := searchFrom + delimOffset
+	return key[:nameEnd], stripPnpmPeerSuffix(key[nameEnd+1:])
+}
+
+// stripPnpmPeerSuffix removes the peer-dependency suffix pnpm appends to
+// versions of packages resolved against non-default peer dependencies: an
+// underscore-hash suffix (`_<peerhash>`) pre-v7, or a parenthesized peer
+// list (`(<peer>@<version>)...`) in v7+.
+func stripPnpmPeerSuffix(version string) string {
+	if idx := strings.IndexAny(version, "_("); idx >= 0 {
+		return version[:idx]
+	}
+	return version
+}
+
+// analyzePnpmLockfile parses `pnpm-lock.yaml` directly instead of globbing
+// `node_modules`, since pnpm's symlinked content-addressable store under
+// `node_modules/.pnpm` makes globbing double-count and miss true resolved
+// versions.
+func analyzePnpmLockfile(lockfilePath string) ([]module.Dependency, error) {
+	nodejsLogger.Debugf("Parsing pnpm lockfile at %#v", lockfilePath)
+	contents, err := ioutil.ReadFile(lockfilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var lockfile pnpmLockfile
+	if err := yaml.Unmarshal(contents, &lockfile); err != nil {
+		return nil, err
+	}
+
+	var deps []module.Dependency
+	for key, pkg := range lockfile.Packages {
+		name, version := parsePnpmPackageKey(key)
+
+		children := make([]string, 0, len(pkg.Dependencies))
+		for child, childVersion := range pkg.Dependencies {
+			if childVersion == "" {
+				children = append(children, child)
+				continue
+			}
+			// Peer-qualified versions (e.g. "2.0.0_eslint@7.0.0") can contain
+			// their own "@", so strip the suffix before joining: it must match
+			// the resolved version on the target node, which is stripped the
+			// same way by parsePnpmPackageKey.
+			children = append(children, child+"@"+stripPnpmPeerSuffix(childVersion))
+		}
+
+		deps = append(deps, NodeModule{Name: name, Version: version, Dependencies: children})
+	}
+
+	return deps, nil
+}
+
+// resolveDependencies dispatches to the first applicable lockfile parser
+// (pnpm > Yarn PnP > Yarn Classic > npm), falling back to globbing
+// `node_modules` directly when no lockfile is present.
+func resolveDependencies(m module.Module) ([]module.Dependency, error) {
+	pnpmLockfilePath := filepath.Join(m.Dir, "pnpm-lock.yaml")
+	if _, err := os.Stat(pnpmLockfilePath); err == nil {
+		return analyzePnpmLockfile(pnpmLockfilePath)
+	}
+
+	pnpDataManifestPath := filepath.Join(m.Dir, ".pnp.data.json")
+	if _, err := os.Stat(pnpDataManifestPath); err == nil {
+		return analyzeYarnPnp(pnpDataManifestPath)
+	}
+
+	// `pnpEnableInlining` defaults to true, so most PnP projects never write
+	// `.pnp.data.json` and embed the manifest in the loader itself instead.
+	pnpCjsPath := filepath.Join(m.Dir, ".pnp.cjs")
+	if _, err := os.Stat(pnpCjsPath); err == nil {
+		return analyzeYarnPnp(pnpCjsPath)
+	}
+
+	yarnLockPath := filepath.Join(m.Dir, "yarn.lock")
+	if _, err := os.Stat(yarnLockPath); err == nil {
+		return analyzeYarnLock(yarnLockPath)
+	}
+
+	packageLockPath := filepath.Join(m.Dir, "package-lock.json")
+	if _, err := os.Stat(packageLockPath); err == nil {
+		return analyzePackageLockJSON(packageLockPath)
+	}
+
+	// No lockfile present; fall back to globbing `node_modules` directly.
 	nodeModules, err := doublestar.Glob(filepath.Join(m.Dir, "**", "node_modules", "*", "package.json"))
 	if err != nil {
 		return nil, err
@@ -174,7 +824,179 @@ func (builder *NodeJSBuilder) Analyze(m module.Module, _ bool) ([]module.Depende
 	return deps, nil
 }
 
+// rootManifestScopes is the subset of a root package.json needed to classify
+// dependencies by scope.
+type rootManifestScopes struct {
+	Dependencies         map[string]string `json:"dependencies"`
+	DevDependencies      map[string]string `json:"devDependencies"`
+	OptionalDependencies map[string]string `json:"optionalDependencies"`
+	PeerDependencies     map[string]string `json:"peerDependencies"`
+	BundledDependencies  []string          `json:"bundledDependencies"`
+}
+
+func mapKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// depIdentity is the composite key used to track a resolved package
+// instance in the scope graph: its name paired with its resolved version.
+// Keying on name alone would collapse a routine diamond dependency (the
+// same name resolved to two different versions for two different scopes)
+// onto a single scope.
+func depIdentity(name, version string) string {
+	return name + "@" + version
+}
+
+// expandDepRef resolves a dependency edge to the node identities it could
+// refer to. pnpm and Yarn PnP edges are recorded as "name@version" using
+// the lockfile's own already-resolved version, so those resolve to exactly
+// one identity; a bare name (a root package.json dependency, or an
+// npm/yarn.lock edge, which only records a semver range rather than a
+// resolved version) can't be matched to one specific resolution, so it
+// expands to every resolved version of that name.
+func expandDepRef(ref string, byName map[string][]string) []string {
+	name := ref
+	if idx := strings.LastIndex(ref, "@"); idx > 0 {
+		name = ref[:idx]
+		for _, identity := range byName[name] {
+			if identity == ref {
+				return []string{identity}
+			}
+		}
+	}
+	return byName[name]
+}
+
+// classifyDepScopes annotates deps with a DepScope by walking the
+// dependency graph (via NodeModule.Dependencies edges, when a lockfile
+// parser populated them) transitively out from each scope declared in the
+// root package.json. A module unreachable from any declared scope (e.g.
+// because it came from the `node_modules`-globbing fallback, which carries
+// no edges) defaults to `prod`.
+func classifyDepScopes(dir string, deps []module.Dependency) {
+	manifestContents, err := ioutil.ReadFile(filepath.Join(dir, "package.json"))
+	if err != nil {
+		nodejsLogger.Debugf("Could not read root package.json for scope classification: %s", err)
+		return
+	}
+
+	var manifest rootManifestScopes
+	if err := json.Unmarshal(manifestContents, &manifest); err != nil {
+		nodejsLogger.Debugf("Could not parse root package.json for scope classification: %s", err)
+		return
+	}
+
+	byName := make(map[string][]string)
+	adjacency := make(map[string][]string)
+	for _, d := range deps {
+		if nm, ok := d.(NodeModule); ok {
+			identity := depIdentity(nm.Name, nm.Version)
+			byName[nm.Name] = append(byName[nm.Name], identity)
+			adjacency[identity] = nm.Dependencies
+		}
+	}
+
+	scopeOf := make(map[string]DepScope)
+	visit := func(roots []string, scope DepScope) {
+		var queue []string
+		for _, root := range roots {
+			queue = append(queue, expandDepRef(root, byName)...)
+		}
+		for len(queue) > 0 {
+			identity := queue[0]
+			queue = queue[1:]
+			if _, seen := scopeOf[identity]; seen {
+				continue
+			}
+			scopeOf[identity] = scope
+			for _, child := range adjacency[identity] {
+				queue = append(queue, expandDepRef(child, byName)...)
+			}
+		}
+	}
+
+	// Visit in priority order: a module reachable from multiple scopes
+	// (e.g. both `dependencies` and `devDependencies`) keeps the first,
+	// most-production-relevant scope it's found under.
+	visit(mapKeys(manifest.Dependencies), ScopeProd)
+	visit(mapKeys(manifest.OptionalDependencies), ScopeOptional)
+	visit(mapKeys(manifest.PeerDependencies), ScopePeer)
+	visit(manifest.BundledDependencies, ScopeBundled)
+	visit(mapKeys(manifest.DevDependencies), ScopeDev)
+
+	for i, d := range deps {
+		nm, ok := d.(NodeModule)
+		if !ok {
+			continue
+		}
+		if scope, ok := scopeOf[depIdentity(nm.Name, nm.Version)]; ok {
+			nm.DepScope = scope
+		} else {
+			nm.DepScope = ScopeProd
+		}
+		deps[i] = nm
+	}
+}
+
+// includedDepScopes determines which scopes Analyze should return. It reads
+// a comma-separated scope list from the `NODEJS_DEP_SCOPES` environment
+// variable (e.g. "prod,optional,peer"); if unset, it defaults to everything
+// except `dev`, matching the production-only installs Build performs.
+func includedDepScopes() map[DepScope]bool {
+	included := map[DepScope]bool{
+		ScopeProd:     true,
+		ScopeOptional: true,
+		ScopePeer:     true,
+		ScopeBundled:  true,
+	}
+
+	raw := os.Getenv("NODEJS_DEP_SCOPES")
+	if raw == "" {
+		return included
+	}
+
+	included = map[DepScope]bool{}
+	for _, scope := range strings.Split(raw, ",") {
+		included[DepScope(strings.TrimSpace(scope))] = true
+	}
+	return included
+}
+
+func (builder *NodeJSBuilder) Analyze(m module.Module, _ bool) ([]module.Dependency, error) {
+	nodejsLogger.Debugf("Running analysis on Nodejs module...")
+
+	deps, err := resolveDependencies(m)
+	if err != nil {
+		return nil, err
+	}
+
+	classifyDepScopes(m.Dir, deps)
+
+	included := includedDepScopes()
+	var filtered []module.Dependency
+	for _, d := range deps {
+		nm, ok := d.(NodeModule)
+		if !ok || included[nm.DepScope] {
+			filtered = append(filtered, d)
+		}
+	}
+
+	return filtered, nil
+}
+
 func (builder *NodeJSBuilder) IsBuilt(m module.Module, _ bool) (bool, error) {
+	// Yarn Berry projects using Plug'n'Play never install `node_modules`, so
+	// the presence of a PnP loader is itself a sign of a completed build.
+	pnpPath := filepath.Join(m.Dir, ".pnp.cjs")
+	if _, err := os.Stat(pnpPath); err == nil {
+		nodejsLogger.Debugf("Found Yarn PnP loader at %#v", pnpPath)
+		return true, nil
+	}
+
 	nodeModulesPath := filepath.Join(m.Dir, "node_modules")
 	nodejsLogger.Debugf("Checking node_modules at %#v", nodeModulesPath)
 	// TODO: Check if the installed modules are consistent with what's in the
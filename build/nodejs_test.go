@@ -0,0 +1,351 @@
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/fossas/fossa-cli/module"
+)
+
+// writeTempFile writes contents to a file named name inside a fresh
+// temporary directory and returns its path, removing the directory when the
+// test completes.
+func writeTempFile(t *testing.T, name, contents string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "fossa-nodejs-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("could not write %#v: %s", path, err)
+	}
+	return path
+}
+
+func TestAnalyzePackageLockJSONV1(t *testing.T) {
+	const fixture = `{
+  "name": "example",
+  "lockfileVersion": 1,
+  "dependencies": {
+    "lodash": {
+      "version": "4.17.21",
+      "resolved": "https://registry.npmjs.org/lodash/-/lodash-4.17.21.tgz",
+      "integrity": "sha512-abc",
+      "requires": {
+        "tiny-dep": "^1.0.0"
+      },
+      "dependencies": {
+        "tiny-dep": {
+          "version": "1.0.1",
+          "requires": {}
+        }
+      }
+    }
+  }
+}`
+	path := writeTempFile(t, "package-lock.json", fixture)
+
+	deps, err := analyzePackageLockJSON(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	byName := sortedNodeModulesByName(t, deps)
+	if len(byName) != 2 {
+		t.Fatalf("expected 2 modules, got %d: %#v", len(byName), byName)
+	}
+
+	lodash := byName["lodash"]
+	if lodash.Version != "4.17.21" {
+		t.Errorf("expected lodash@4.17.21, got %#v", lodash.Version)
+	}
+	if len(lodash.Dependencies) != 1 || lodash.Dependencies[0] != "tiny-dep" {
+		t.Errorf("expected lodash to depend on [tiny-dep], got %#v", lodash.Dependencies)
+	}
+
+	tinyDep := byName["tiny-dep"]
+	if tinyDep.Version != "1.0.1" {
+		t.Errorf("expected nested tiny-dep@1.0.1, got %#v", tinyDep.Version)
+	}
+}
+
+func TestAnalyzePackageLockJSONV2(t *testing.T) {
+	const fixture = `{
+  "name": "example",
+  "lockfileVersion": 2,
+  "packages": {
+    "": {
+      "name": "example"
+    },
+    "node_modules/lodash": {
+      "version": "4.17.21",
+      "resolved": "https://registry.npmjs.org/lodash/-/lodash-4.17.21.tgz",
+      "integrity": "sha512-abc",
+      "dependencies": {
+        "tiny-dep": "^1.0.0"
+      }
+    },
+    "node_modules/@scope/tiny-dep": {
+      "version": "1.0.1"
+    }
+  }
+}`
+	path := writeTempFile(t, "package-lock.json", fixture)
+
+	deps, err := analyzePackageLockJSON(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	byName := sortedNodeModulesByName(t, deps)
+	if len(byName) != 2 {
+		t.Fatalf("expected 2 modules (root excluded), got %d: %#v", len(byName), byName)
+	}
+
+	lodash := byName["lodash"]
+	if lodash.Version != "4.17.21" || lodash.Resolved == "" {
+		t.Errorf("unexpected lodash entry: %#v", lodash)
+	}
+
+	scopedDep := byName["@scope/tiny-dep"]
+	if scopedDep.Version != "1.0.1" {
+		t.Errorf("expected scoped name recovered from path, got %#v", byName)
+	}
+}
+
+func TestAnalyzeYarnLock(t *testing.T) {
+	const fixture = `# THIS IS AN AUTOGENERATED FILE.
+lodash@^4.17.21:
+  version "4.17.21"
+  resolved "https://registry.yarnpkg.com/lodash/-/lodash-4.17.21.tgz"
+  integrity sha512-abc
+  dependencies:
+    tiny-dep "^1.0.0"
+
+"@scope/tiny-dep@^1.0.0":
+  version "1.0.1"
+  resolved "https://registry.yarnpkg.com/@scope/tiny-dep/-/tiny-dep-1.0.1.tgz"
+  integrity sha512-def
+`
+	path := writeTempFile(t, "yarn.lock", fixture)
+
+	deps, err := analyzeYarnLock(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	byName := sortedNodeModulesByName(t, deps)
+	if len(byName) != 2 {
+		t.Fatalf("expected 2 modules, got %d: %#v", len(byName), byName)
+	}
+
+	lodash := byName["lodash"]
+	if lodash.Version != "4.17.21" {
+		t.Errorf("expected lodash@4.17.21, got %#v", lodash)
+	}
+	if len(lodash.Dependencies) != 1 || lodash.Dependencies[0] != "tiny-dep" {
+		t.Errorf("expected lodash to depend on [tiny-dep], got %#v", lodash.Dependencies)
+	}
+
+	scopedDep := byName["@scope/tiny-dep"]
+	if scopedDep.Version != "1.0.1" {
+		t.Errorf("expected scoped dependency name to survive the comma-descriptor header, got %#v", byName)
+	}
+}
+
+func TestAnalyzePnpmLockfile(t *testing.T) {
+	const fixture = `lockfileVersion: 5.4
+
+packages:
+  /lodash@4.17.21:
+    resolution: {integrity: sha512-abc}
+    dependencies:
+      tiny-dep: 1.0.1
+      peer-dep: 2.0.0_eslint@7.0.0
+  /tiny-dep@1.0.1_peerhash123:
+    resolution: {integrity: sha512-def}
+  /peer-dep@2.0.0_eslint@7.0.0:
+    resolution: {integrity: sha512-jkl}
+  /eslint-plugin-jest@27.2.1(eslint@8.35.0)(jest@29.5.0):
+    resolution: {integrity: sha512-mno}
+  /dev-only@2.0.0:
+    resolution: {integrity: sha512-ghi}
+    dev: true
+`
+	path := writeTempFile(t, "pnpm-lock.yaml", fixture)
+
+	deps, err := analyzePnpmLockfile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	byName := sortedNodeModulesByName(t, deps)
+	if len(byName) != 5 {
+		t.Fatalf("expected dev-only packages to still be parsed (scope filtering happens later), got %d: %#v", len(byName), byName)
+	}
+
+	lodash := byName["lodash"]
+	if lodash.Version != "4.17.21" {
+		t.Errorf("expected lodash@4.17.21, got %#v", lodash)
+	}
+	if len(lodash.Dependencies) != 2 {
+		t.Fatalf("expected lodash to have 2 dependency edges, got %#v", lodash.Dependencies)
+	}
+	hasEdge := func(edge string) bool {
+		for _, d := range lodash.Dependencies {
+			if d == edge {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasEdge("tiny-dep@1.0.1") {
+		t.Errorf("expected lodash to depend on tiny-dep@1.0.1, got %#v", lodash.Dependencies)
+	}
+	// The peer-hash suffix on a peer-qualified dependency version (itself
+	// containing an "@") must be stripped so the edge matches the target
+	// node's own (identically stripped) identity.
+	if !hasEdge("peer-dep@2.0.0") {
+		t.Errorf("expected peer suffix stripped from peer-dep edge, got %#v", lodash.Dependencies)
+	}
+
+	tinyDep := byName["tiny-dep"]
+	if tinyDep.Version != "1.0.1" {
+		t.Errorf("expected underscore peer-hash suffix stripped from tiny-dep's version, got %#v", tinyDep.Version)
+	}
+
+	// pnpm v7+'s parenthetical peer format: the version itself contains
+	// "(name@version)" segments, whose own "@" must not be mistaken for the
+	// name/version delimiter.
+	eslintPluginJest := byName["eslint-plugin-jest"]
+	if eslintPluginJest.Version != "27.2.1" {
+		t.Errorf("expected parenthetical peer suffix stripped, got name=%#v version=%#v", eslintPluginJest.Name, eslintPluginJest.Version)
+	}
+}
+
+// yarnPnpFixture is a real Yarn Berry `packageRegistryData` shape: a JS
+// `Map<packageName, Map<packageReference, PackageInformation>>` serialized as
+// nested `[key, value]` tuple arrays (since JS Map keys, including null,
+// can't round-trip through a plain JSON object), plus a null-keyed root entry
+// and a `workspace:.` self-entry that PnP always emits alongside real deps.
+const yarnPnpFixture = `{
+  "packageRegistryData": [
+    [null, [
+      [null, {
+        "packageDependencies": [
+          ["demo", "workspace:."]
+        ]
+      }]
+    ]],
+    ["demo", [
+      ["workspace:.", {
+        "packageDependencies": [
+          ["demo", "workspace:."],
+          ["lodash", "npm:4.17.21"]
+        ]
+      }]
+    ]],
+    ["lodash", [
+      ["npm:4.17.21::__archiveUrl=https%3A%2F%2Fexample.invalid%2Flodash-4.17.21.tgz", {
+        "packageDependencies": [
+          ["lodash", "npm:4.17.21::__archiveUrl=https%3A%2F%2Fexample.invalid%2Flodash-4.17.21.tgz"],
+          ["tiny-dep", "npm:1.0.1"]
+        ]
+      }]
+    ]],
+    ["tiny-dep", [
+      ["npm:1.0.1", {
+        "packageDependencies": [
+          ["tiny-dep", "npm:1.0.1"]
+        ]
+      }]
+    ]]
+  ]
+}`
+
+func TestAnalyzeYarnPnpStandaloneManifest(t *testing.T) {
+	path := writeTempFile(t, ".pnp.data.json", yarnPnpFixture)
+
+	deps, err := analyzeYarnPnp(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	byName := sortedNodeModulesByName(t, deps)
+	if len(byName) != 2 {
+		t.Fatalf("expected the null-keyed root entry and the workspace:. self-entry to be skipped, leaving 2 packages, got %d: %#v", len(byName), byName)
+	}
+
+	lodash := byName["lodash"]
+	// The archive-URL query parameters after "::" aren't part of the
+	// version and must be stripped along with the "npm:" protocol prefix.
+	if lodash.Version != "4.17.21" {
+		t.Errorf("expected lodash@4.17.21 with archive-URL params stripped, got %#v", lodash)
+	}
+	// Real PnP data includes a self-referential entry in
+	// packageDependencies, which isn't a real edge and must be filtered out.
+	wantDeps := []string{"tiny-dep@1.0.1"}
+	if !reflect.DeepEqual(lodash.Dependencies, wantDeps) {
+		t.Errorf("expected lodash to depend on %#v, got %#v", wantDeps, lodash.Dependencies)
+	}
+
+	tinyDep := byName["tiny-dep"]
+	if tinyDep.Version != "1.0.1" {
+		t.Errorf("expected tiny-dep@1.0.1, got %#v", tinyDep)
+	}
+}
+
+func TestAnalyzeYarnPnpInlinedInLoader(t *testing.T) {
+	escaped := strings.ReplaceAll(yarnPnpFixture, `'`, `\'`)
+	escaped = strings.ReplaceAll(escaped, "\n", "")
+	fixture := "/* eslint-disable */\n" +
+		"function $$SETUP_STATE(hydrateRuntimeState, basePath) {\n" +
+		"  return hydrateRuntimeState(JSON.parse('" + escaped + "'), {basePath});\n" +
+		"}\n"
+	path := writeTempFile(t, ".pnp.cjs", fixture)
+
+	deps, err := analyzeYarnPnp(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	byName := sortedNodeModulesByName(t, deps)
+	lodash := byName["lodash"]
+	if lodash.Version != "4.17.21" {
+		t.Errorf("expected lodash@4.17.21 extracted from inlined loader, got %#v", lodash)
+	}
+}
+
+func TestAnalyzeYarnPnpInlinedMissingCall(t *testing.T) {
+	path := writeTempFile(t, ".pnp.cjs", "module.exports = {};\n")
+
+	if _, err := analyzeYarnPnp(path); err == nil {
+		t.Error("expected an error when .pnp.cjs has no hydrateRuntimeState(JSON.parse(...)) call")
+	}
+}
+
+// sortedNodeModulesByName asserts every returned dependency is a NodeModule
+// and indexes them by name for convenient table-test lookups.
+func sortedNodeModulesByName(t *testing.T, deps []module.Dependency) map[string]NodeModule {
+	t.Helper()
+	byName := make(map[string]NodeModule, len(deps))
+	var names []string
+	for _, d := range deps {
+		nm, ok := d.(NodeModule)
+		if !ok {
+			t.Fatalf("expected a NodeModule, got %#v", d)
+		}
+		byName[nm.Name] = nm
+		names = append(names, nm.Name)
+	}
+	sort.Strings(names)
+	return byName
+}